@@ -1,28 +1,46 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 type Action string
 
 const (
-	ApplySCP       Action = "apply_scp"
-	DeleteRole     Action = "delete_role"
-	DetachPolicies Action = "detach_policies"
+	ApplySCP            Action = "apply_scp"
+	DeleteRole          Action = "delete_role"
+	DetachPolicies      Action = "detach_policies"
+	DetachSCP           Action = "detach_scp"
+	RestoreRole         Action = "restore_role"
+	DeleteUser          Action = "delete_user"
+	DetachUserPolicies  Action = "detach_user_policies"
+	DeleteGroup         Action = "delete_group"
+	DetachGroupPolicies Action = "detach_group_policies"
 	// Default region to be used if the region is not specified by the user
 	DefaultRegion = "us-east-1"
+	// Default number of targets processed concurrently when Request.Targets
+	// is used and MaxConcurrency is not set
+	DefaultWorkerPoolSize = 10
 )
 
 type Request struct {
@@ -30,8 +48,117 @@ type Request struct {
 	TargetAccountID        string `json:"target_account_id"`
 	RoleToAssume           string `json:"role_to_assume"`
 	TargetRoleName         string `json:"target_role_name,omitempty"`       // Used for delete_role & detach_policies actions
+	TargetUserName         string `json:"target_user_name,omitempty"`       // Used for delete_user & detach_user_policies actions
+	TargetGroupName        string `json:"target_group_name,omitempty"`      // Used for delete_group & detach_group_policies actions
 	OrgManagementAccountID string `json:"org_management_account,omitempty"` // Used for apply_scp action
 	Region                 string `json:"region,omitempty"`
+	PolicyID               string `json:"policy_id,omitempty"`    // SCP policy ID to detach, used for detach_scp action
+	PolicyName             string `json:"policy_name,omitempty"`  // SCP policy name, resolved to a PolicyID for detach_scp when PolicyID is unknown
+	SnapshotKey            string `json:"snapshot_key,omitempty"` // Snapshot key to restore from, used for restore_role action
+
+	// DeleteSCP opts detach_scp into also deleting the policy after
+	// detaching it. It defaults to false because detach_scp fans out over
+	// Targets (the same SCP attached to several accounts), and a policy
+	// deleted by the first target's detach would make every later target's
+	// DetachPolicy/DeletePolicy fail; callers that know this is the last
+	// target can set it explicitly once they're done.
+	DeleteSCP bool `json:"delete_scp,omitempty"`
+
+	// DeleteInstanceProfiles opts delete_role into also deleting instance
+	// profiles once targetRoleName has been removed from them. It defaults
+	// to false: removing the role is enough to let DeleteRole succeed, and
+	// the instance profile itself may still be referenced by running EC2
+	// instances and isn't captured by a role snapshot, so deleting it is
+	// unrecoverable by restore_role.
+	DeleteInstanceProfiles bool `json:"delete_instance_profiles,omitempty"`
+
+	// ManagedPolicyArns and InlinePolicies let a caller restore a role without
+	// going through a snapshot, by supplying the policies to reattach directly.
+	ManagedPolicyArns []string          `json:"managed_policy_arns,omitempty"`
+	InlinePolicies    map[string]string `json:"inline_policies,omitempty"`
+
+	// Targets fans the same Action out across multiple accounts/roles in one
+	// invocation. When set, it takes precedence over the top-level
+	// TargetAccountID/Region/TargetRoleName/RoleToAssume fields, which are
+	// otherwise treated as a single implicit target for backward compatibility.
+	Targets []Target `json:"targets,omitempty"`
+	// MaxConcurrency caps how many targets are processed at once. Defaults to
+	// DefaultWorkerPoolSize.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	// PolicyArnPrefixes and RequiredPolicyTag are opt-in filters for
+	// detach_policies: when set, manageRole only detaches managed policies
+	// whose ARN starts with one of PolicyArnPrefixes or whose policy carries
+	// RequiredPolicyTag, leaving any other attached policy alone. delete_role
+	// rejects a request that sets either of them.
+	// Leaving both unset preserves the default behavior of detaching everything.
+	PolicyArnPrefixes []string   `json:"policy_arn_prefixes,omitempty"`
+	RequiredPolicyTag *TagFilter `json:"required_policy_tag,omitempty"`
+
+	// DryRun makes apply_scp and manageRole-backed actions (detach_policies,
+	// delete_role) skip every mutating AWS call. Instead they enumerate the
+	// current state read-only and return a rendered AWS CLI script of the
+	// commands that would have run, so a responder can review the blast
+	// radius before pulling the trigger for real. It is not yet implemented
+	// for the user/group/SCP/restore actions; dispatchAction rejects it
+	// there rather than silently ignoring it.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// DryRunResult is returned instead of mutating when Request.DryRun is set.
+// Script is a shell script equivalent to Commands, so an operator or auditor
+// has a reproducible artifact of what would happen. For apply_scp, the
+// attach-policy command holds a placeholder where the policy ID returned by
+// create-policy goes.
+type DryRunResult struct {
+	TargetAccountID string   `json:"target_account_id"`
+	Commands        []string `json:"commands"`
+	Script          string   `json:"script"`
+}
+
+// TagFilter matches a single IAM resource tag key/value pair.
+type TagFilter struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Target identifies a single account/role to apply Request.Action to when
+// fanning out across multiple accounts. Any empty field falls back to the
+// corresponding top-level Request field.
+type Target struct {
+	TargetAccountID string `json:"target_account_id"`
+	Region          string `json:"region,omitempty"`
+	TargetRoleName  string `json:"target_role_name,omitempty"`
+	TargetUserName  string `json:"target_user_name,omitempty"`
+	TargetGroupName string `json:"target_group_name,omitempty"`
+	RoleToAssume    string `json:"role_to_assume,omitempty"`
+}
+
+// TargetResult is the outcome of running Request.Action against a single
+// Target.
+type TargetResult struct {
+	TargetAccountID string `json:"target_account_id"`
+	Success         bool   `json:"success"`
+	Message         string `json:"message,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// RoleRestoreResult describes what was reattached by a restore_role action.
+type RoleRestoreResult struct {
+	TargetAccountID        string   `json:"target_account_id"`
+	TargetRoleName         string   `json:"target_role_name"`
+	SnapshotKey            string   `json:"snapshot_key,omitempty"`
+	RoleRecreated          bool     `json:"role_recreated,omitempty"`
+	ReattachedManagedArns  []string `json:"reattached_managed_arns"`
+	RestoredInlinePolicies []string `json:"restored_inline_policies"`
+}
+
+// SCPDetachResult describes what was detached/deleted by a detach_scp action.
+type SCPDetachResult struct {
+	TargetAccountID string `json:"target_account_id"`
+	PolicyID        string `json:"policy_id"`
+	Detached        bool   `json:"detached"`
+	Deleted         bool   `json:"deleted"`
 }
 
 type Config struct {
@@ -39,22 +166,144 @@ type Config struct {
 	SwitchPolicies      struct {
 		SCPolicy json.RawMessage `json:"scpPolicy"`
 	} `json:"switchPolicies"`
+	Snapshot SnapshotConfig `json:"snapshot"`
+}
+
+// SnapshotConfig selects where manageRole persists a role's state before
+// mutating it, so that state can later be handed to the restore_role action.
+// Leaving Backend unset (the default, since this field is optional) skips
+// snapshotting entirely rather than failing detach_policies/delete_role.
+type SnapshotConfig struct {
+	Backend       string `json:"backend"` // "s3" or "dynamodb"
+	S3Bucket      string `json:"s3Bucket,omitempty"`
+	DynamoDBTable string `json:"dynamoDbTable,omitempty"`
+	KMSKeyID      string `json:"kmsKeyId,omitempty"`
+}
+
+// RoleSnapshot is the full role state captured before manageRole detaches
+// policies or deletes a role, so it can be restored later by restore_role.
+type RoleSnapshot struct {
+	AccountID                 string            `json:"account_id"`
+	RoleName                  string            `json:"role_name"`
+	Timestamp                 string            `json:"timestamp"`
+	Path                      string            `json:"path"`
+	TrustPolicy               string            `json:"trust_policy"`
+	Tags                      []*iam.Tag        `json:"tags,omitempty"`
+	PermissionsBoundaryArn    string            `json:"permissions_boundary_arn,omitempty"`
+	AttachedManagedPolicyArns []string          `json:"attached_managed_policy_arns"`
+	InlinePolicies            map[string]string `json:"inline_policies"`
 }
 
 func HandleRequest(ctx context.Context, request Request) (string, error) {
-	if request.TargetAccountID == "" || request.RoleToAssume == "" {
-		return "", errors.New("targetAccountID and roleToAssume are required")
+	targets := request.Targets
+	if len(targets) == 0 {
+		// No Targets given: treat the top-level fields as a single implicit
+		// target, the pre-fan-out behavior.
+		targets = []Target{{
+			TargetAccountID: request.TargetAccountID,
+			Region:          request.Region,
+			TargetRoleName:  request.TargetRoleName,
+			TargetUserName:  request.TargetUserName,
+			TargetGroupName: request.TargetGroupName,
+			RoleToAssume:    request.RoleToAssume,
+		}}
 	}
 
-	// Default to us-east-1 if Region is not provided
-	if request.Region == "" {
-		request.Region = DefaultRegion
+	workerPoolSize := DefaultWorkerPoolSize
+	if request.MaxConcurrency > 0 {
+		workerPoolSize = request.MaxConcurrency
+	}
+
+	results := make([]TargetResult, len(targets))
+	sem := make(chan struct{}, workerPoolSize)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, target Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = runTarget(ctx, request, target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	out, err := json.Marshal(results)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling results: %v", err)
+	}
+
+	var failed int
+	for _, result := range results {
+		if !result.Success {
+			failed++
+		}
+	}
+	if failed > 0 {
+		// Still return the structured body alongside the error so a caller
+		// inspecting the Lambda error payload can see which targets failed,
+		// but a non-nil error is what makes CloudWatch alarms, Step
+		// Functions retries, and `aws lambda invoke`'s exit code notice.
+		return string(out), fmt.Errorf("%d of %d targets failed", failed, len(results))
+	}
+	return string(out), nil
+}
+
+// runTarget resolves a Target's fields against the request's top-level
+// defaults and executes request.Action against it.
+func runTarget(ctx context.Context, request Request, target Target) TargetResult {
+	targetAccountID := target.TargetAccountID
+	if targetAccountID == "" {
+		targetAccountID = request.TargetAccountID
+	}
+	result := TargetResult{TargetAccountID: targetAccountID}
+
+	roleToAssume := target.RoleToAssume
+	if roleToAssume == "" {
+		roleToAssume = request.RoleToAssume
+	}
+	if targetAccountID == "" || roleToAssume == "" {
+		result.Error = "targetAccountID and roleToAssume are required"
+		return result
+	}
+
+	region := target.Region
+	if region == "" {
+		region = request.Region
+	}
+	if region == "" {
+		region = DefaultRegion
+	}
+
+	targetRoleName := target.TargetRoleName
+	if targetRoleName == "" {
+		targetRoleName = request.TargetRoleName
+	}
+	targetUserName := target.TargetUserName
+	if targetUserName == "" {
+		targetUserName = request.TargetUserName
+	}
+	targetGroupName := target.TargetGroupName
+	if targetGroupName == "" {
+		targetGroupName = request.TargetGroupName
 	}
 
 	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(request.Region),
+		Region: aws.String(region),
 	}))
 
+	message, err := dispatchAction(ctx, sess, request, targetAccountID, roleToAssume, targetRoleName, targetUserName, targetGroupName)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Success = true
+	result.Message = message
+	return result
+}
+
+// dispatchAction runs request.Action against a single resolved target.
+func dispatchAction(ctx context.Context, sess *session.Session, request Request, targetAccountID, roleToAssume, targetRoleName, targetUserName, targetGroupName string) (string, error) {
 	switch request.Action {
 	case ApplySCP:
 		if request.OrgManagementAccountID == "" {
@@ -66,17 +315,153 @@ func HandleRequest(ctx context.Context, request Request) (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("error loading config file: %v", err)
 		}
-		return applySCP(ctx, sess, request.OrgManagementAccountID, request.TargetAccountID, request.RoleToAssume, config)
+		return applySCP(ctx, sess, request.OrgManagementAccountID, targetAccountID, roleToAssume, config, request.DryRun)
 	case DetachPolicies, DeleteRole:
-		if request.TargetRoleName == "" {
+		if targetRoleName == "" {
 			return "", errors.New("targetRoleName is required for delete_role and detach_policies actions")
 		}
-		return manageRole(ctx, sess, request.Action, request.TargetAccountID, request.RoleToAssume, request.TargetRoleName)
+		if request.Action == DeleteRole && (len(request.PolicyArnPrefixes) > 0 || request.RequiredPolicyTag != nil) {
+			// policyArnPrefixes/requiredPolicyTag exist to leave some of a
+			// role's policies attached for forensics, which is incompatible
+			// with delete_role: DeleteRole requires every policy detached
+			// first and would just fail with DeleteConflict once the filter
+			// preserved one. Only detach_policies can use a filter.
+			return "", errors.New("policyArnPrefixes/requiredPolicyTag are not supported for delete_role, only detach_policies")
+		}
+		// Load the snapshot backend config so the role's state is captured
+		// before it gets mutated.
+		config, err := loadConfig("switch.conf")
+		if err != nil {
+			return "", fmt.Errorf("error loading config file: %v", err)
+		}
+		return manageRole(ctx, sess, request.Action, targetAccountID, roleToAssume, targetRoleName, config.Snapshot, request.PolicyArnPrefixes, request.RequiredPolicyTag, request.DeleteInstanceProfiles, request.DryRun)
+	case DetachUserPolicies, DeleteUser:
+		if targetUserName == "" {
+			return "", errors.New("targetUserName is required for delete_user and detach_user_policies actions")
+		}
+		if request.DryRun {
+			return "", fmt.Errorf("dry_run is not supported for action %q", request.Action)
+		}
+		return manageUser(ctx, sess, request.Action, targetAccountID, roleToAssume, targetUserName)
+	case DetachGroupPolicies, DeleteGroup:
+		if targetGroupName == "" {
+			return "", errors.New("targetGroupName is required for delete_group and detach_group_policies actions")
+		}
+		if request.DryRun {
+			return "", fmt.Errorf("dry_run is not supported for action %q", request.Action)
+		}
+		return manageGroup(ctx, sess, request.Action, targetAccountID, roleToAssume, targetGroupName)
+	case DetachSCP:
+		if request.OrgManagementAccountID == "" {
+			return "", errors.New("managementAccount is required for detach_scp action")
+		}
+		if request.PolicyID == "" && request.PolicyName == "" {
+			return "", errors.New("policyId or policyName is required for detach_scp action")
+		}
+		if request.DryRun {
+			return "", fmt.Errorf("dry_run is not supported for action %q", request.Action)
+		}
+		return detachSCP(ctx, sess, request.OrgManagementAccountID, targetAccountID, roleToAssume, request.PolicyID, request.PolicyName, request.DeleteSCP)
+	case RestoreRole:
+		if targetRoleName == "" {
+			return "", errors.New("targetRoleName is required for restore_role action")
+		}
+		if request.DryRun {
+			return "", fmt.Errorf("dry_run is not supported for action %q", request.Action)
+		}
+		var snapshotCfg SnapshotConfig
+		if request.SnapshotKey != "" && len(request.ManagedPolicyArns) == 0 && len(request.InlinePolicies) == 0 {
+			// Caller wants the snapshot replayed rather than supplying the
+			// policies directly: load the same backend config manageRole
+			// used to write it.
+			config, err := loadConfig("switch.conf")
+			if err != nil {
+				return "", fmt.Errorf("error loading config file: %v", err)
+			}
+			snapshotCfg = config.Snapshot
+		}
+		return restoreRole(ctx, sess, snapshotCfg, targetAccountID, roleToAssume, targetRoleName, request.SnapshotKey, request.ManagedPolicyArns, request.InlinePolicies)
 	default:
 		return "", errors.New("invalid action")
 	}
 }
 
+const (
+	maxRetryAttempts = 5
+	retryBaseDelay   = 100 * time.Millisecond
+)
+
+// isRetryableError reports whether an AWS error indicates the caller should
+// back off and retry. A kill switch invoked during an active incident will
+// be hammering the API alongside the attacker's own activity, so these show
+// up far more often than in steady-state usage.
+func isRetryableError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded", "ConcurrentModificationException":
+		return true
+	default:
+		return false
+	}
+}
+
+// withRetry retries fn with exponential backoff while it returns a
+// retryable AWS error, giving up after maxRetryAttempts or when ctx is
+// canceled.
+func withRetry(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxRetryAttempts; attempt++ {
+		err = fn()
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+		if attempt == maxRetryAttempts-1 {
+			break
+		}
+		delay := retryBaseDelay * time.Duration(1<<attempt)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// shellQuote wraps s in single quotes for safe inclusion in the rendered
+// dry-run script, escaping any single quotes already in s.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// renderScript turns a list of AWS CLI commands into a runnable shell script.
+func renderScript(commands []string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/bash\nset -euo pipefail\n\n")
+	for _, command := range commands {
+		b.WriteString(command)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// renderDryRunResult marshals commands into the DryRunResult JSON payload
+// returned in place of mutating when Request.DryRun is set.
+func renderDryRunResult(targetAccountID string, commands []string) (string, error) {
+	out, err := json.Marshal(DryRunResult{
+		TargetAccountID: targetAccountID,
+		Commands:        commands,
+		Script:          renderScript(commands),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error marshaling dry_run result: %v", err)
+	}
+	return string(out), nil
+}
+
 // Load awskillswitch.conf if needed
 func loadConfig(filename string) (*Config, error) {
 	var config Config
@@ -91,7 +476,7 @@ func loadConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
-func applySCP(ctx context.Context, sess *session.Session, managementAccount, targetAccountID, roleToAssume string, config *Config) (string, error) {
+func applySCP(ctx context.Context, sess *session.Session, managementAccount, targetAccountID, roleToAssume string, config *Config, dryRun bool) (string, error) {
 	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", managementAccount, roleToAssume))
 	svc := organizations.New(sess, &aws.Config{Credentials: creds})
 
@@ -106,7 +491,21 @@ func applySCP(ctx context.Context, sess *session.Session, managementAccount, tar
 		Type:        aws.String("SERVICE_CONTROL_POLICY"),
 	}
 
-	policyResp, err := svc.CreatePolicy(createPolicyInput)
+	if dryRun {
+		commands := []string{
+			fmt.Sprintf("aws organizations create-policy --content %s --description %s --name %s --type SERVICE_CONTROL_POLICY",
+				shellQuote(scpPolicy), shellQuote("Highly Restrictive SCP"), shellQuote("HighlyRestrictiveSCP")),
+			fmt.Sprintf("aws organizations attach-policy --policy-id <POLICY_ID_FROM_CREATE_POLICY> --target-id %s", targetAccountID),
+		}
+		return renderDryRunResult(targetAccountID, commands)
+	}
+
+	var policyResp *organizations.CreatePolicyOutput
+	err := withRetry(ctx, func() error {
+		var err error
+		policyResp, err = svc.CreatePolicyWithContext(ctx, createPolicyInput)
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("error creating SCP: %v", err)
 	}
@@ -117,7 +516,10 @@ func applySCP(ctx context.Context, sess *session.Session, managementAccount, tar
 		TargetId: aws.String(targetAccountID),
 	}
 
-	_, err = svc.AttachPolicy(attachPolicyInput)
+	err = withRetry(ctx, func() error {
+		_, err := svc.AttachPolicyWithContext(ctx, attachPolicyInput)
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("error attaching SCP to account %s: %v", targetAccountID, err)
 	}
@@ -126,21 +528,51 @@ func applySCP(ctx context.Context, sess *session.Session, managementAccount, tar
 }
 
 // Actions involving role manipulation or deletion
-func manageRole(ctx context.Context, sess *session.Session, action Action, targetAccountID, roleToAssume, targetRoleName string) (string, error) {
+func manageRole(ctx context.Context, sess *session.Session, action Action, targetAccountID, roleToAssume, targetRoleName string, snapshotCfg SnapshotConfig, policyArnPrefixes []string, requiredPolicyTag *TagFilter, deleteInstanceProfiles, dryRun bool) (string, error) {
 	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
 	svc := iam.New(sess, &aws.Config{Credentials: creds})
 
-	// List attached managed policies
-	listPoliciesOutput, err := svc.ListAttachedRolePolicies(&iam.ListAttachedRolePoliciesInput{RoleName: aws.String(targetRoleName)})
+	if dryRun {
+		return dryRunManageRole(ctx, svc, action, targetAccountID, targetRoleName, policyArnPrefixes, requiredPolicyTag, deleteInstanceProfiles)
+	}
+
+	// Capture the role's current state before anything is detached or
+	// deleted, so it can be fed back into a restore_role action.
+	snapshotKey, err := snapshotRole(ctx, sess, svc, snapshotCfg, targetAccountID, targetRoleName)
+	if err != nil {
+		return "", fmt.Errorf("error snapshotting role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+
+	// List attached managed policies. The List* APIs are paginated and
+	// default to 100 results per page, so a role with more attached
+	// policies than that would otherwise silently keep some attached.
+	var attachedPolicies []*iam.AttachedPolicy
+	err = svc.ListAttachedRolePoliciesPagesWithContext(ctx, &iam.ListAttachedRolePoliciesInput{RoleName: aws.String(targetRoleName)},
+		func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+			attachedPolicies = append(attachedPolicies, page.AttachedPolicies...)
+			return true
+		})
 	if err != nil {
 		return "", fmt.Errorf("error listing attached policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
 	}
 
-	// Detach each managed policy
-	for _, policy := range listPoliciesOutput.AttachedPolicies {
-		_, err = svc.DetachRolePolicy(&iam.DetachRolePolicyInput{
-			RoleName:  aws.String(targetRoleName),
-			PolicyArn: policy.PolicyArn,
+	// Detach each managed policy, unless policyArnPrefixes/requiredPolicyTag
+	// are set and this policy matches neither - that lets an operator
+	// preserve policies a human will need for forensics after containment.
+	for _, policy := range attachedPolicies {
+		matches, err := policyMatchesFilter(ctx, svc, *policy.PolicyArn, policyArnPrefixes, requiredPolicyTag)
+		if err != nil {
+			return "", fmt.Errorf("error checking filter for policy %s on role %s in account %s: %v", *policy.PolicyArn, targetRoleName, targetAccountID, err)
+		}
+		if !matches {
+			continue
+		}
+		err = withRetry(ctx, func() error {
+			_, err := svc.DetachRolePolicyWithContext(ctx, &iam.DetachRolePolicyInput{
+				RoleName:  aws.String(targetRoleName),
+				PolicyArn: policy.PolicyArn,
+			})
+			return err
 		})
 		if err != nil {
 			return "", fmt.Errorf("error detaching policy %s from role %s in account %s: %v", *policy.PolicyArn, targetRoleName, targetAccountID, err)
@@ -148,31 +580,828 @@ func manageRole(ctx context.Context, sess *session.Session, action Action, targe
 	}
 
 	// List inline policies
-	listInlinePoliciesOutput, err := svc.ListRolePolicies(&iam.ListRolePoliciesInput{RoleName: aws.String(targetRoleName)})
+	var inlinePolicyNames []*string
+	err = svc.ListRolePoliciesPagesWithContext(ctx, &iam.ListRolePoliciesInput{RoleName: aws.String(targetRoleName)},
+		func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+			inlinePolicyNames = append(inlinePolicyNames, page.PolicyNames...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing inline policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+
+	// Delete each inline policy. Unlike managed policies, inline policies
+	// have no ARN or tags to check against policyArnPrefixes/
+	// requiredPolicyTag, so when either filter is configured we leave
+	// inline policies attached rather than deleting something a filter was
+	// specifically set up to preserve.
+	if len(policyArnPrefixes) == 0 && requiredPolicyTag == nil {
+		for _, policyName := range inlinePolicyNames {
+			err = withRetry(ctx, func() error {
+				_, err := svc.DeleteRolePolicyWithContext(ctx, &iam.DeleteRolePolicyInput{
+					RoleName:   aws.String(targetRoleName),
+					PolicyName: policyName,
+				})
+				return err
+			})
+			if err != nil {
+				return "", fmt.Errorf("error deleting inline policy %s from role %s in account %s: %v", *policyName, targetRoleName, targetAccountID, err)
+			}
+		}
+	}
+
+	// Delete the role if Action is delete_role
+	if action == DeleteRole {
+		// DeleteRole fails if the role is still attached to an instance
+		// profile, which is the common case for EC2 compromise scenarios.
+		if err := removeRoleFromInstanceProfiles(ctx, svc, targetRoleName, targetAccountID, deleteInstanceProfiles); err != nil {
+			return "", err
+		}
+
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteRoleWithContext(ctx, &iam.DeleteRoleInput{RoleName: aws.String(targetRoleName)})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deleting role %s in account %s: %v", targetRoleName, targetAccountID, err)
+		}
+		return fmt.Sprintf("Role %s and its policies are detached and deleted in account %s%s", targetRoleName, targetAccountID, snapshotSuffix(snapshotKey)), nil
+	}
+	return fmt.Sprintf("Policies detached from role %s in account %s%s", targetRoleName, targetAccountID, snapshotSuffix(snapshotKey)), nil
+}
+
+// snapshotSuffix renders the "(snapshot: ...)" note appended to manageRole's
+// success messages, or "" when no snapshot was taken (no backend configured).
+func snapshotSuffix(snapshotKey string) string {
+	if snapshotKey == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (snapshot: %s)", snapshotKey)
+}
+
+// dryRunManageRole performs the same read-only enumeration manageRole would
+// act on, but instead of mutating anything it returns the AWS CLI commands
+// that would have run, so a responder can review the blast radius first.
+func dryRunManageRole(ctx context.Context, svc *iam.IAM, action Action, targetAccountID, targetRoleName string, policyArnPrefixes []string, requiredPolicyTag *TagFilter, deleteInstanceProfiles bool) (string, error) {
+	var attachedPolicies []*iam.AttachedPolicy
+	err := svc.ListAttachedRolePoliciesPagesWithContext(ctx, &iam.ListAttachedRolePoliciesInput{RoleName: aws.String(targetRoleName)},
+		func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+			attachedPolicies = append(attachedPolicies, page.AttachedPolicies...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing attached policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+
+	var inlinePolicyNames []*string
+	err = svc.ListRolePoliciesPagesWithContext(ctx, &iam.ListRolePoliciesInput{RoleName: aws.String(targetRoleName)},
+		func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+			inlinePolicyNames = append(inlinePolicyNames, page.PolicyNames...)
+			return true
+		})
 	if err != nil {
 		return "", fmt.Errorf("error listing inline policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
 	}
 
-	// Delete each inline policy
-	for _, policyName := range listInlinePoliciesOutput.PolicyNames {
-		_, err = svc.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+	var commands []string
+	for _, policy := range attachedPolicies {
+		matches, err := policyMatchesFilter(ctx, svc, *policy.PolicyArn, policyArnPrefixes, requiredPolicyTag)
+		if err != nil {
+			return "", fmt.Errorf("error checking filter for policy %s on role %s in account %s: %v", *policy.PolicyArn, targetRoleName, targetAccountID, err)
+		}
+		if !matches {
+			continue
+		}
+		commands = append(commands, fmt.Sprintf("aws iam detach-role-policy --role-name %s --policy-arn %s", targetRoleName, *policy.PolicyArn))
+	}
+	// As in manageRole, inline policies have no ARN/tag to filter against,
+	// so leave them out of the rendered script when a filter is configured.
+	if len(policyArnPrefixes) == 0 && requiredPolicyTag == nil {
+		for _, policyName := range inlinePolicyNames {
+			commands = append(commands, fmt.Sprintf("aws iam delete-role-policy --role-name %s --policy-name %s", targetRoleName, *policyName))
+		}
+	}
+
+	if action == DeleteRole {
+		listInstanceProfilesOutput, err := svc.ListInstanceProfilesForRoleWithContext(ctx, &iam.ListInstanceProfilesForRoleInput{RoleName: aws.String(targetRoleName)})
+		if err != nil {
+			return "", fmt.Errorf("error listing instance profiles for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+		}
+		for _, instanceProfile := range listInstanceProfilesOutput.InstanceProfiles {
+			commands = append(commands, fmt.Sprintf("aws iam remove-role-from-instance-profile --instance-profile-name %s --role-name %s", *instanceProfile.InstanceProfileName, targetRoleName))
+			if deleteInstanceProfiles {
+				commands = append(commands, fmt.Sprintf("aws iam delete-instance-profile --instance-profile-name %s", *instanceProfile.InstanceProfileName))
+			}
+		}
+		commands = append(commands, fmt.Sprintf("aws iam delete-role --role-name %s", targetRoleName))
+	}
+
+	return renderDryRunResult(targetAccountID, commands)
+}
+
+// policyMatchesFilter reports whether policyArn should be detached, given an
+// optional allowlist of ARN prefixes and/or a required tag. With no filters
+// configured, every policy matches, preserving manageRole's default behavior
+// of detaching everything.
+func policyMatchesFilter(ctx context.Context, svc *iam.IAM, policyArn string, policyArnPrefixes []string, requiredPolicyTag *TagFilter) (bool, error) {
+	if len(policyArnPrefixes) == 0 && requiredPolicyTag == nil {
+		return true, nil
+	}
+
+	for _, prefix := range policyArnPrefixes {
+		if strings.HasPrefix(policyArn, prefix) {
+			return true, nil
+		}
+	}
+
+	if requiredPolicyTag != nil {
+		tagsOutput, err := svc.ListPolicyTagsWithContext(ctx, &iam.ListPolicyTagsInput{PolicyArn: aws.String(policyArn)})
+		if err != nil {
+			return false, fmt.Errorf("error listing tags for policy %s: %v", policyArn, err)
+		}
+		for _, tag := range tagsOutput.Tags {
+			if *tag.Key == requiredPolicyTag.Key && *tag.Value == requiredPolicyTag.Value {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// removeRoleFromInstanceProfiles removes targetRoleName from every instance
+// profile it is attached to, since a role still attached to an instance
+// profile cannot be deleted - the common case when responding to an EC2
+// compromise. It only deletes the now-empty instance profiles when
+// deleteInstanceProfiles is set: the profile may still be referenced by
+// running EC2 instances, and unlike the role itself it isn't captured by a
+// snapshot, so deleting it isn't something restore_role can undo.
+func removeRoleFromInstanceProfiles(ctx context.Context, svc *iam.IAM, targetRoleName, targetAccountID string, deleteInstanceProfiles bool) error {
+	listInstanceProfilesOutput, err := svc.ListInstanceProfilesForRoleWithContext(ctx, &iam.ListInstanceProfilesForRoleInput{RoleName: aws.String(targetRoleName)})
+	if err != nil {
+		return fmt.Errorf("error listing instance profiles for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+
+	for _, instanceProfile := range listInstanceProfilesOutput.InstanceProfiles {
+		err := withRetry(ctx, func() error {
+			_, err := svc.RemoveRoleFromInstanceProfileWithContext(ctx, &iam.RemoveRoleFromInstanceProfileInput{
+				InstanceProfileName: instanceProfile.InstanceProfileName,
+				RoleName:            aws.String(targetRoleName),
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error removing role %s from instance profile %s in account %s: %v", targetRoleName, *instanceProfile.InstanceProfileName, targetAccountID, err)
+		}
+
+		if !deleteInstanceProfiles {
+			continue
+		}
+
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteInstanceProfileWithContext(ctx, &iam.DeleteInstanceProfileInput{InstanceProfileName: instanceProfile.InstanceProfileName})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting instance profile %s in account %s: %v", *instanceProfile.InstanceProfileName, targetAccountID, err)
+		}
+	}
+	return nil
+}
+
+// manageUser detaches a user's managed and inline policies and, for
+// delete_user, purges every credential that could still be used to
+// authenticate as the user (access keys, console login, MFA devices,
+// signing certs, SSH public keys) before deleting the user itself.
+func manageUser(ctx context.Context, sess *session.Session, action Action, targetAccountID, roleToAssume, targetUserName string) (string, error) {
+	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
+	svc := iam.New(sess, &aws.Config{Credentials: creds})
+
+	// The List* APIs below are paginated and default to 100 results per
+	// page, so a user with more attachments than that would otherwise be
+	// left with some still in place after this runs.
+	var attachedPolicies []*iam.AttachedPolicy
+	err := svc.ListAttachedUserPoliciesPagesWithContext(ctx, &iam.ListAttachedUserPoliciesInput{UserName: aws.String(targetUserName)},
+		func(page *iam.ListAttachedUserPoliciesOutput, lastPage bool) bool {
+			attachedPolicies = append(attachedPolicies, page.AttachedPolicies...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing attached policies for user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	for _, policy := range attachedPolicies {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DetachUserPolicyWithContext(ctx, &iam.DetachUserPolicyInput{
+				UserName:  aws.String(targetUserName),
+				PolicyArn: policy.PolicyArn,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error detaching policy %s from user %s in account %s: %v", *policy.PolicyArn, targetUserName, targetAccountID, err)
+		}
+	}
+
+	var inlinePolicyNames []*string
+	err = svc.ListUserPoliciesPagesWithContext(ctx, &iam.ListUserPoliciesInput{UserName: aws.String(targetUserName)},
+		func(page *iam.ListUserPoliciesOutput, lastPage bool) bool {
+			inlinePolicyNames = append(inlinePolicyNames, page.PolicyNames...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing inline policies for user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	for _, policyName := range inlinePolicyNames {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteUserPolicyWithContext(ctx, &iam.DeleteUserPolicyInput{
+				UserName:   aws.String(targetUserName),
+				PolicyName: policyName,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deleting inline policy %s from user %s in account %s: %v", *policyName, targetUserName, targetAccountID, err)
+		}
+	}
+
+	if action != DeleteUser {
+		return fmt.Sprintf("Policies detached from user %s in account %s", targetUserName, targetAccountID), nil
+	}
+
+	var accessKeys []*iam.AccessKeyMetadata
+	err = svc.ListAccessKeysPagesWithContext(ctx, &iam.ListAccessKeysInput{UserName: aws.String(targetUserName)},
+		func(page *iam.ListAccessKeysOutput, lastPage bool) bool {
+			accessKeys = append(accessKeys, page.AccessKeyMetadata...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing access keys for user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	for _, accessKey := range accessKeys {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteAccessKeyWithContext(ctx, &iam.DeleteAccessKeyInput{
+				UserName:    aws.String(targetUserName),
+				AccessKeyId: accessKey.AccessKeyId,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deleting access key %s for user %s in account %s: %v", *accessKey.AccessKeyId, targetUserName, targetAccountID, err)
+		}
+	}
+
+	err = withRetry(ctx, func() error {
+		_, err := svc.DeleteLoginProfileWithContext(ctx, &iam.DeleteLoginProfileInput{UserName: aws.String(targetUserName)})
+		return err
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != iam.ErrCodeNoSuchEntityException {
+			return "", fmt.Errorf("error deleting login profile for user %s in account %s: %v", targetUserName, targetAccountID, err)
+		}
+	}
+
+	var mfaDevices []*iam.MFADevice
+	err = svc.ListMFADevicesPagesWithContext(ctx, &iam.ListMFADevicesInput{UserName: aws.String(targetUserName)},
+		func(page *iam.ListMFADevicesOutput, lastPage bool) bool {
+			mfaDevices = append(mfaDevices, page.MFADevices...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing MFA devices for user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	for _, mfaDevice := range mfaDevices {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeactivateMFADeviceWithContext(ctx, &iam.DeactivateMFADeviceInput{
+				UserName:     aws.String(targetUserName),
+				SerialNumber: mfaDevice.SerialNumber,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deactivating MFA device %s for user %s in account %s: %v", *mfaDevice.SerialNumber, targetUserName, targetAccountID, err)
+		}
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteVirtualMFADeviceWithContext(ctx, &iam.DeleteVirtualMFADeviceInput{SerialNumber: mfaDevice.SerialNumber})
+			return err
+		})
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != iam.ErrCodeNoSuchEntityException {
+				return "", fmt.Errorf("error deleting virtual MFA device %s in account %s: %v", *mfaDevice.SerialNumber, targetAccountID, err)
+			}
+		}
+	}
+
+	var signingCerts []*iam.SigningCertificate
+	err = svc.ListSigningCertificatesPagesWithContext(ctx, &iam.ListSigningCertificatesInput{UserName: aws.String(targetUserName)},
+		func(page *iam.ListSigningCertificatesOutput, lastPage bool) bool {
+			signingCerts = append(signingCerts, page.Certificates...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing signing certificates for user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	for _, cert := range signingCerts {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteSigningCertificateWithContext(ctx, &iam.DeleteSigningCertificateInput{
+				UserName:      aws.String(targetUserName),
+				CertificateId: cert.CertificateId,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deleting signing certificate %s for user %s in account %s: %v", *cert.CertificateId, targetUserName, targetAccountID, err)
+		}
+	}
+
+	var sshKeys []*iam.SSHPublicKeyMetadata
+	err = svc.ListSSHPublicKeysPagesWithContext(ctx, &iam.ListSSHPublicKeysInput{UserName: aws.String(targetUserName)},
+		func(page *iam.ListSSHPublicKeysOutput, lastPage bool) bool {
+			sshKeys = append(sshKeys, page.SSHPublicKeys...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing SSH public keys for user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	for _, sshKey := range sshKeys {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteSSHPublicKeyWithContext(ctx, &iam.DeleteSSHPublicKeyInput{
+				UserName:       aws.String(targetUserName),
+				SSHPublicKeyId: sshKey.SSHPublicKeyId,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deleting SSH public key %s for user %s in account %s: %v", *sshKey.SSHPublicKeyId, targetUserName, targetAccountID, err)
+		}
+	}
+
+	// DeleteUser fails with DeleteConflict if the user still belongs to any
+	// group, so remove those memberships too.
+	var userGroups []*iam.Group
+	err = svc.ListGroupsForUserPagesWithContext(ctx, &iam.ListGroupsForUserInput{UserName: aws.String(targetUserName)},
+		func(page *iam.ListGroupsForUserOutput, lastPage bool) bool {
+			userGroups = append(userGroups, page.Groups...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing groups for user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	for _, group := range userGroups {
+		err = withRetry(ctx, func() error {
+			_, err := svc.RemoveUserFromGroupWithContext(ctx, &iam.RemoveUserFromGroupInput{
+				GroupName: group.GroupName,
+				UserName:  aws.String(targetUserName),
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error removing user %s from group %s in account %s: %v", targetUserName, *group.GroupName, targetAccountID, err)
+		}
+	}
+
+	err = withRetry(ctx, func() error {
+		_, err := svc.DeleteUserWithContext(ctx, &iam.DeleteUserInput{UserName: aws.String(targetUserName)})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error deleting user %s in account %s: %v", targetUserName, targetAccountID, err)
+	}
+	return fmt.Sprintf("User %s and its policies and credentials are detached and deleted in account %s", targetUserName, targetAccountID), nil
+}
+
+// manageGroup detaches a group's managed and inline policies and, for
+// delete_group, removes any remaining members and deletes the group.
+func manageGroup(ctx context.Context, sess *session.Session, action Action, targetAccountID, roleToAssume, targetGroupName string) (string, error) {
+	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
+	svc := iam.New(sess, &aws.Config{Credentials: creds})
+
+	// The List*/GetGroup APIs below are paginated and default to 100
+	// results per page, so a group with more attachments or members than
+	// that would otherwise be left with some still in place after this runs.
+	var attachedPolicies []*iam.AttachedPolicy
+	err := svc.ListAttachedGroupPoliciesPagesWithContext(ctx, &iam.ListAttachedGroupPoliciesInput{GroupName: aws.String(targetGroupName)},
+		func(page *iam.ListAttachedGroupPoliciesOutput, lastPage bool) bool {
+			attachedPolicies = append(attachedPolicies, page.AttachedPolicies...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing attached policies for group %s in account %s: %v", targetGroupName, targetAccountID, err)
+	}
+	for _, policy := range attachedPolicies {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DetachGroupPolicyWithContext(ctx, &iam.DetachGroupPolicyInput{
+				GroupName: aws.String(targetGroupName),
+				PolicyArn: policy.PolicyArn,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error detaching policy %s from group %s in account %s: %v", *policy.PolicyArn, targetGroupName, targetAccountID, err)
+		}
+	}
+
+	var inlinePolicyNames []*string
+	err = svc.ListGroupPoliciesPagesWithContext(ctx, &iam.ListGroupPoliciesInput{GroupName: aws.String(targetGroupName)},
+		func(page *iam.ListGroupPoliciesOutput, lastPage bool) bool {
+			inlinePolicyNames = append(inlinePolicyNames, page.PolicyNames...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing inline policies for group %s in account %s: %v", targetGroupName, targetAccountID, err)
+	}
+	for _, policyName := range inlinePolicyNames {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeleteGroupPolicyWithContext(ctx, &iam.DeleteGroupPolicyInput{
+				GroupName:  aws.String(targetGroupName),
+				PolicyName: policyName,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deleting inline policy %s from group %s in account %s: %v", *policyName, targetGroupName, targetAccountID, err)
+		}
+	}
+
+	if action != DeleteGroup {
+		return fmt.Sprintf("Policies detached from group %s in account %s", targetGroupName, targetAccountID), nil
+	}
+
+	var groupMembers []*iam.User
+	err = svc.GetGroupPagesWithContext(ctx, &iam.GetGroupInput{GroupName: aws.String(targetGroupName)},
+		func(page *iam.GetGroupOutput, lastPage bool) bool {
+			groupMembers = append(groupMembers, page.Users...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error getting members of group %s in account %s: %v", targetGroupName, targetAccountID, err)
+	}
+	for _, user := range groupMembers {
+		err = withRetry(ctx, func() error {
+			_, err := svc.RemoveUserFromGroupWithContext(ctx, &iam.RemoveUserFromGroupInput{
+				GroupName: aws.String(targetGroupName),
+				UserName:  user.UserName,
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error removing user %s from group %s in account %s: %v", *user.UserName, targetGroupName, targetAccountID, err)
+		}
+	}
+
+	err = withRetry(ctx, func() error {
+		_, err := svc.DeleteGroupWithContext(ctx, &iam.DeleteGroupInput{GroupName: aws.String(targetGroupName)})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error deleting group %s in account %s: %v", targetGroupName, targetAccountID, err)
+	}
+	return fmt.Sprintf("Group %s and its policies and members are detached and deleted in account %s", targetGroupName, targetAccountID), nil
+}
+
+// snapshotRole captures a role's trust policy, tags, path, permissions
+// boundary, attached managed policy ARNs, and inline policy documents, and
+// persists them to the configured backend keyed by
+// {accountID}/{roleName}/{timestamp}. It returns that key so it can be fed
+// back into a restore_role action.
+func snapshotRole(ctx context.Context, sess *session.Session, svc *iam.IAM, snapshotCfg SnapshotConfig, targetAccountID, targetRoleName string) (string, error) {
+	if snapshotCfg.Backend == "" {
+		// No snapshot backend configured: this field predates every existing
+		// switch.conf, so detach_policies/delete_role must keep working
+		// without one instead of hard-failing the kill switch.
+		return "", nil
+	}
+
+	roleOutput, err := svc.GetRoleWithContext(ctx, &iam.GetRoleInput{RoleName: aws.String(targetRoleName)})
+	if err != nil {
+		return "", fmt.Errorf("error getting role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+
+	// The List* APIs are paginated and default to 100 results per page, so
+	// a role with more attached/inline policies than that would otherwise
+	// be snapshotted incompletely.
+	var attachedPolicies []*iam.AttachedPolicy
+	err = svc.ListAttachedRolePoliciesPagesWithContext(ctx, &iam.ListAttachedRolePoliciesInput{RoleName: aws.String(targetRoleName)},
+		func(page *iam.ListAttachedRolePoliciesOutput, lastPage bool) bool {
+			attachedPolicies = append(attachedPolicies, page.AttachedPolicies...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing attached policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+	attachedArns := make([]string, 0, len(attachedPolicies))
+	for _, policy := range attachedPolicies {
+		attachedArns = append(attachedArns, *policy.PolicyArn)
+	}
+
+	var inlinePolicyNames []*string
+	err = svc.ListRolePoliciesPagesWithContext(ctx, &iam.ListRolePoliciesInput{RoleName: aws.String(targetRoleName)},
+		func(page *iam.ListRolePoliciesOutput, lastPage bool) bool {
+			inlinePolicyNames = append(inlinePolicyNames, page.PolicyNames...)
+			return true
+		})
+	if err != nil {
+		return "", fmt.Errorf("error listing inline policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+	inlineDocuments := make(map[string]string, len(inlinePolicyNames))
+	for _, policyName := range inlinePolicyNames {
+		policyOutput, err := svc.GetRolePolicyWithContext(ctx, &iam.GetRolePolicyInput{
 			RoleName:   aws.String(targetRoleName),
 			PolicyName: policyName,
 		})
 		if err != nil {
-			return "", fmt.Errorf("error deleting inline policy %s from role %s in account %s: %v", *policyName, targetRoleName, targetAccountID, err)
+			return "", fmt.Errorf("error getting inline policy %s for role %s in account %s: %v", *policyName, targetRoleName, targetAccountID, err)
+		}
+		// IAM returns policy documents URL-encoded; decode now so the
+		// snapshot holds plain JSON ready to replay into PutRolePolicy.
+		document, err := url.QueryUnescape(*policyOutput.PolicyDocument)
+		if err != nil {
+			return "", fmt.Errorf("error decoding inline policy %s for role %s in account %s: %v", *policyName, targetRoleName, targetAccountID, err)
+		}
+		inlineDocuments[*policyName] = document
+	}
+
+	trustPolicy, err := url.QueryUnescape(*roleOutput.Role.AssumeRolePolicyDocument)
+	if err != nil {
+		return "", fmt.Errorf("error decoding trust policy for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+
+	snapshot := RoleSnapshot{
+		AccountID:                 targetAccountID,
+		RoleName:                  targetRoleName,
+		Timestamp:                 time.Now().UTC().Format(time.RFC3339),
+		Path:                      *roleOutput.Role.Path,
+		TrustPolicy:               trustPolicy,
+		Tags:                      roleOutput.Role.Tags,
+		AttachedManagedPolicyArns: attachedArns,
+		InlinePolicies:            inlineDocuments,
+	}
+	if roleOutput.Role.PermissionsBoundary != nil {
+		snapshot.PermissionsBoundaryArn = *roleOutput.Role.PermissionsBoundary.PermissionsBoundaryArn
+	}
+
+	snapshotKey := fmt.Sprintf("%s/%s/%s", targetAccountID, targetRoleName, snapshot.Timestamp)
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling snapshot for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+	}
+
+	switch snapshotCfg.Backend {
+	case "s3":
+		s3svc := s3.New(sess)
+		putObjectInput := &s3.PutObjectInput{
+			Bucket: aws.String(snapshotCfg.S3Bucket),
+			Key:    aws.String(snapshotKey),
+			Body:   bytes.NewReader(body),
+		}
+		if snapshotCfg.KMSKeyID != "" {
+			putObjectInput.ServerSideEncryption = aws.String("aws:kms")
+			putObjectInput.SSEKMSKeyId = aws.String(snapshotCfg.KMSKeyID)
+		}
+		if _, err := s3svc.PutObjectWithContext(ctx, putObjectInput); err != nil {
+			return "", fmt.Errorf("error writing snapshot %s to bucket %s: %v", snapshotKey, snapshotCfg.S3Bucket, err)
+		}
+	case "dynamodb":
+		ddbsvc := dynamodb.New(sess)
+		_, err := ddbsvc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(snapshotCfg.DynamoDBTable),
+			Item: map[string]*dynamodb.AttributeValue{
+				"SnapshotKey": {S: aws.String(snapshotKey)},
+				"Snapshot":    {S: aws.String(string(body))},
+			},
+		})
+		if err != nil {
+			return "", fmt.Errorf("error writing snapshot %s to table %s: %v", snapshotKey, snapshotCfg.DynamoDBTable, err)
 		}
+	default:
+		return "", fmt.Errorf("unsupported snapshot backend %q", snapshotCfg.Backend)
 	}
 
-	// Delete the role if Action is delete_role
-	if action == DeleteRole {
-		_, err = svc.DeleteRole(&iam.DeleteRoleInput{RoleName: aws.String(targetRoleName)})
+	return snapshotKey, nil
+}
+
+// loadSnapshot reads back a RoleSnapshot previously written by snapshotRole,
+// so restore_role can replay it by snapshotKey instead of the caller having
+// to resupply the policies by hand.
+func loadSnapshot(ctx context.Context, sess *session.Session, snapshotCfg SnapshotConfig, snapshotKey string) (*RoleSnapshot, error) {
+	var body []byte
+	switch snapshotCfg.Backend {
+	case "s3":
+		s3svc := s3.New(sess)
+		getObjectOutput, err := s3svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(snapshotCfg.S3Bucket),
+			Key:    aws.String(snapshotKey),
+		})
 		if err != nil {
-			return "", fmt.Errorf("error deleting role %s in account %s: %v", targetRoleName, targetAccountID, err)
+			return nil, fmt.Errorf("error reading snapshot %s from bucket %s: %v", snapshotKey, snapshotCfg.S3Bucket, err)
+		}
+		defer getObjectOutput.Body.Close()
+		body, err = io.ReadAll(getObjectOutput.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s body from bucket %s: %v", snapshotKey, snapshotCfg.S3Bucket, err)
+		}
+	case "dynamodb":
+		ddbsvc := dynamodb.New(sess)
+		getItemOutput, err := ddbsvc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(snapshotCfg.DynamoDBTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"SnapshotKey": {S: aws.String(snapshotKey)},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s from table %s: %v", snapshotKey, snapshotCfg.DynamoDBTable, err)
+		}
+		if getItemOutput.Item == nil || getItemOutput.Item["Snapshot"] == nil {
+			return nil, fmt.Errorf("snapshot %s not found in table %s", snapshotKey, snapshotCfg.DynamoDBTable)
+		}
+		body = []byte(*getItemOutput.Item["Snapshot"].S)
+	default:
+		return nil, fmt.Errorf("unsupported snapshot backend %q", snapshotCfg.Backend)
+	}
+
+	var snapshot RoleSnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return nil, fmt.Errorf("error unmarshaling snapshot %s: %v", snapshotKey, err)
+	}
+	return &snapshot, nil
+}
+
+// detachSCP undoes applySCP: it detaches the given SCP from the target
+// account and, only when deletePolicy is set, also deletes it. Deletion is
+// opt-in because detach_scp fans out over Targets and every target shares
+// the same SCP; deleting it as soon as the first target detaches would
+// make DeletePolicy/DetachPolicy fail for every target still attached
+// (PolicyInUseException or NoSuchEntity), so callers should only set it
+// once they know every target has been detached. Callers that don't know
+// the policy's ID can instead supply policyName, which is resolved to an
+// ID first.
+func detachSCP(ctx context.Context, sess *session.Session, managementAccount, targetAccountID, roleToAssume, policyID, policyName string, deletePolicy bool) (string, error) {
+	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", managementAccount, roleToAssume))
+	svc := organizations.New(sess, &aws.Config{Credentials: creds})
+
+	if policyID == "" {
+		resolved, err := resolveSCPPolicyID(ctx, svc, policyName)
+		if err != nil {
+			return "", err
+		}
+		policyID = resolved
+	}
+
+	result := SCPDetachResult{
+		TargetAccountID: targetAccountID,
+		PolicyID:        policyID,
+	}
+
+	err := withRetry(ctx, func() error {
+		_, err := svc.DetachPolicyWithContext(ctx, &organizations.DetachPolicyInput{
+			PolicyId: aws.String(policyID),
+			TargetId: aws.String(targetAccountID),
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error detaching SCP %s from account %s: %v", policyID, targetAccountID, err)
+	}
+	result.Detached = true
+
+	if deletePolicy {
+		err = withRetry(ctx, func() error {
+			_, err := svc.DeletePolicyWithContext(ctx, &organizations.DeletePolicyInput{
+				PolicyId: aws.String(policyID),
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error deleting SCP %s: %v", policyID, err)
+		}
+		result.Deleted = true
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling detach_scp result: %v", err)
+	}
+	return string(out), nil
+}
+
+// resolveSCPPolicyID looks up a service control policy's ID by name, for
+// callers of detach_scp that don't have the ID handy.
+func resolveSCPPolicyID(ctx context.Context, svc *organizations.Organizations, policyName string) (string, error) {
+	var policyID string
+	err := svc.ListPoliciesPagesWithContext(ctx, &organizations.ListPoliciesInput{
+		Filter: aws.String("SERVICE_CONTROL_POLICY"),
+	}, func(page *organizations.ListPoliciesOutput, lastPage bool) bool {
+		for _, summary := range page.Policies {
+			if *summary.Name == policyName {
+				policyID = *summary.Id
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", fmt.Errorf("error listing SCPs to resolve name %s: %v", policyName, err)
+	}
+	if policyID == "" {
+		return "", fmt.Errorf("no SCP named %s found", policyName)
+	}
+	return policyID, nil
+}
+
+// restoreRole re-attaches managed and inline policies to a role that was
+// previously stripped by manageRole. Callers can supply the policies to
+// restore directly (managedPolicyArns, inlinePolicies) or, once the role's
+// state has been captured by a snapshot, reference it by snapshotKey and
+// have it loaded from snapshotCfg's backend. If delete_role ran and the
+// role itself is gone, a snapshot-backed restore recreates it first from
+// the snapshotted trust policy, path, tags, and permissions boundary.
+func restoreRole(ctx context.Context, sess *session.Session, snapshotCfg SnapshotConfig, targetAccountID, roleToAssume, targetRoleName, snapshotKey string, managedPolicyArns []string, inlinePolicies map[string]string) (string, error) {
+	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
+	svc := iam.New(sess, &aws.Config{Credentials: creds})
+
+	var snapshot *RoleSnapshot
+	if snapshotKey != "" && len(managedPolicyArns) == 0 && len(inlinePolicies) == 0 {
+		var err error
+		snapshot, err = loadSnapshot(ctx, sess, snapshotCfg, snapshotKey)
+		if err != nil {
+			return "", fmt.Errorf("error loading snapshot %s: %v", snapshotKey, err)
+		}
+		managedPolicyArns = snapshot.AttachedManagedPolicyArns
+		inlinePolicies = snapshot.InlinePolicies
+	}
+
+	result := RoleRestoreResult{
+		TargetAccountID: targetAccountID,
+		TargetRoleName:  targetRoleName,
+		SnapshotKey:     snapshotKey,
+	}
+
+	_, err := svc.GetRoleWithContext(ctx, &iam.GetRoleInput{RoleName: aws.String(targetRoleName)})
+	if err != nil {
+		awsErr, ok := err.(awserr.Error)
+		if !ok || awsErr.Code() != iam.ErrCodeNoSuchEntityException {
+			return "", fmt.Errorf("error checking for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+		}
+		if snapshot == nil {
+			return "", fmt.Errorf("role %s no longer exists in account %s, and no snapshot is available to recreate it from (a snapshotKey only loads a snapshot when managedPolicyArns and inlinePolicies are both empty)", targetRoleName, targetAccountID)
+		}
+		createRoleInput := &iam.CreateRoleInput{
+			RoleName:                 aws.String(targetRoleName),
+			Path:                     aws.String(snapshot.Path),
+			AssumeRolePolicyDocument: aws.String(snapshot.TrustPolicy),
+			Tags:                     snapshot.Tags,
+		}
+		if snapshot.PermissionsBoundaryArn != "" {
+			createRoleInput.PermissionsBoundary = aws.String(snapshot.PermissionsBoundaryArn)
+		}
+		err = withRetry(ctx, func() error {
+			_, err := svc.CreateRoleWithContext(ctx, createRoleInput)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error recreating role %s in account %s: %v", targetRoleName, targetAccountID, err)
+		}
+		// CreateRole can return before the role is visible to the policy
+		// APIs below, so wait for it to propagate rather than racing it.
+		if err := svc.WaitUntilRoleExistsWithContext(ctx, &iam.GetRoleInput{RoleName: aws.String(targetRoleName)}); err != nil {
+			return "", fmt.Errorf("error waiting for recreated role %s in account %s to propagate: %v", targetRoleName, targetAccountID, err)
+		}
+		result.RoleRecreated = true
+	}
+
+	for _, policyArn := range managedPolicyArns {
+		err := withRetry(ctx, func() error {
+			_, err := svc.AttachRolePolicyWithContext(ctx, &iam.AttachRolePolicyInput{
+				RoleName:  aws.String(targetRoleName),
+				PolicyArn: aws.String(policyArn),
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error reattaching policy %s to role %s in account %s: %v", policyArn, targetRoleName, targetAccountID, err)
+		}
+		result.ReattachedManagedArns = append(result.ReattachedManagedArns, policyArn)
+	}
+
+	for policyName, policyDocument := range inlinePolicies {
+		err := withRetry(ctx, func() error {
+			_, err := svc.PutRolePolicyWithContext(ctx, &iam.PutRolePolicyInput{
+				RoleName:       aws.String(targetRoleName),
+				PolicyName:     aws.String(policyName),
+				PolicyDocument: aws.String(policyDocument),
+			})
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error restoring inline policy %s on role %s in account %s: %v", policyName, targetRoleName, targetAccountID, err)
 		}
-		return fmt.Sprintf("Role %s and its policies are detached and deleted in account %s", targetRoleName, targetAccountID), nil
+		result.RestoredInlinePolicies = append(result.RestoredInlinePolicies, policyName)
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling restore_role result: %v", err)
 	}
-	return fmt.Sprintf("Policies detached from role %s in account %s", targetRoleName, targetAccountID), nil
+	return string(out), nil
 }
 
 func main() {